@@ -1,6 +1,7 @@
 package blight
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"sync"
@@ -15,6 +16,9 @@ var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 type DB struct {
 	db *bolt.DB
+	// gcm is set when the DB was opened with NewEncrypted, and transparently
+	// encrypts/decrypts values stored through the JSON helpers.
+	gcm cipher.AEAD
 }
 
 func New(db *bolt.DB) *DB {
@@ -34,6 +38,12 @@ func (d DB) SetJSON(bucket, key string, value interface{}) error {
 		return err
 	}
 
+	if d.gcm != nil {
+		if j, err = encrypt(d.gcm, j); err != nil {
+			return err
+		}
+	}
+
 	return Set(d.db, []byte(bucket), []byte(key), j)
 }
 
@@ -61,28 +71,24 @@ func (d DB) DeleteBucket(bucket string) error {
 	return err
 }
 
+// SetJSONBatch marshals value and stores it at bucket/key, coalescing the
+// write with other concurrent SetJSONBatch calls into a single bbolt
+// transaction. For more control over batch size and delay, use NewWriter.
 func (d DB) SetJSONBatch(bucket, key string, value interface{}) error {
-	defer func() {
-		if r := recover(); r != nil {
-			logrus.Info("Recovered in SetJSONBatch", r)
-		}
-	}()
-
 	j, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
-	err = d.db.Batch(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(bucket))
-		err = bkt.Put([]byte(key), j)
-		if err != nil {
-			logrus.Fatal(err)
+	if d.gcm != nil {
+		if j, err = encrypt(d.gcm, j); err != nil {
+			return err
 		}
-		return nil
-	})
+	}
 
-	return nil
+	return d.db.Batch(func(tx *bolt.Tx) error {
+		return setTx(tx, []byte(bucket), []byte(key), j)
+	})
 }
 
 func (d DB) AppendJSON(bucket string, value interface{}) error {
@@ -90,46 +96,30 @@ func (d DB) AppendJSON(bucket string, value interface{}) error {
 	if err != nil {
 		return err
 	}
+	if d.gcm != nil {
+		if j, err = encrypt(d.gcm, j); err != nil {
+			return err
+		}
+	}
 	return Append(d.db, []byte(bucket), j)
 }
 
+// Set writes key/value to bucket through db.Batch, which may share the
+// transaction with other concurrent Batch calls, delegating to setTx.
 func Set(db *bolt.DB, bucket, key, value []byte) error {
-	err := db.Batch(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(bucket)
-		if err != nil {
-			return err
-		}
-
-		err = bucket.Put(key, value)
-		if err != nil {
-			return err
-		}
-		return nil
+	return db.Batch(func(tx *bolt.Tx) error {
+		return setTx(tx, bucket, key, value)
 	})
-
-	return err
 }
 
+// Append writes value to bucket under a sequence-generated key through
+// db.Batch, which may share the transaction with other concurrent Batch
+// calls, delegating to appendTx.
 func Append(db *bolt.DB, bucket, value []byte) error {
-	err := db.Batch(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(bucket)
-		if err != nil {
-			return err
-		}
-
-		// Generate ID.
-		// This returns an error only if the Tx is closed or not writeable.
-		// That can't happen in an Update() call so I ignore the error check.
-		id, _ := bucket.NextSequence()
-
-		err = bucket.Put(itob(id), value)
-		if err != nil {
-			return err
-		}
-		return nil
+	return db.Batch(func(tx *bolt.Tx) error {
+		_, err := appendTx(tx, bucket, value)
+		return err
 	})
-
-	return err
 }
 
 // itob returns an 8-byte big endian representation of v.
@@ -139,16 +129,13 @@ func itob(v uint64) []byte {
 	return b
 }
 
+// Get reads key from bucket in its own transaction, delegating to getTx.
 func Get(db *bolt.DB, bucket, key []byte) ([]byte, error) {
 	var val []byte
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
-			return fmt.Errorf("bucket %q not found", string(bucket))
-		}
-
-		val = b.Get(key)
-		return nil
+		v, err := getTx(tx, bucket, key)
+		val = v
+		return err
 	})
 
 	return val, err
@@ -159,6 +146,11 @@ func (d DB) GetJSON(bucket, key string, value interface{}) error {
 	if err != nil {
 		return err
 	}
+	if d.gcm != nil {
+		if vs, err = decrypt(d.gcm, vs); err != nil {
+			return err
+		}
+	}
 	return json.Unmarshal(vs, &value)
 }
 
@@ -177,13 +169,17 @@ func (d DB) AllFunc(bucket string, fn func(k, v []byte)) error {
 		}
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
+			// k and v are only valid for the lifetime of this transaction,
+			// so copy them before handing them to a goroutine.
+			kc := append([]byte(nil), k...)
+			vc := append([]byte(nil), v...)
 			<-tokens
 			wg.Add(1)
 			go func(k, v []byte) {
 				fn(k, v)
 				wg.Done()
 				tokens <- struct{}{}
-			}(k, v)
+			}(kc, vc)
 		}
 
 		wg.Wait()
@@ -215,28 +211,17 @@ func DeleteS(db *bolt.DB, bucket, key string) error {
 	return err
 }
 
+// Delete removes key from bucket in its own transaction, delegating to deleteTx.
 func Delete(db *bolt.DB, bucket, key []byte) error {
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
-			return fmt.Errorf("bucket %q not found", string(bucket))
-		}
-
-		return b.Delete(key)
+	return db.Update(func(tx *bolt.Tx) error {
+		return deleteTx(tx, bucket, key)
 	})
-
-	return err
 }
 
+// ResetBucket empties bucket in its own transaction, delegating to resetBucketTx.
 func ResetBucket(db *bolt.DB, bucket []byte) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucket)
-		if err != nil {
-			return err
-		}
-
-		_, err = tx.CreateBucketIfNotExists(bucket)
-		return err
+		return resetBucketTx(tx, bucket)
 	})
 }
 
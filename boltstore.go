@@ -0,0 +1,42 @@
+package blight
+
+import bolt "go.etcd.io/bbolt"
+
+// BoltStore adapts *DB to the Store interface.
+type BoltStore struct {
+	*DB
+	raw *bolt.DB
+}
+
+// NewBoltStore wraps db as a Store.
+func NewBoltStore(db *bolt.DB) *BoltStore {
+	return &BoltStore{DB: New(db), raw: db}
+}
+
+func (s *BoltStore) Get(bucket, key []byte) ([]byte, error) {
+	return Get(s.raw, bucket, key)
+}
+
+func (s *BoltStore) Set(bucket, key, value []byte) error {
+	return Set(s.raw, bucket, key, value)
+}
+
+func (s *BoltStore) Delete(bucket, key []byte) error {
+	return Delete(s.raw, bucket, key)
+}
+
+func (s *BoltStore) Append(bucket, value []byte) error {
+	return Append(s.raw, bucket, value)
+}
+
+// Batch groups fn with other concurrent Batch calls into a single bbolt
+// transaction, the same way SetJSONBatch does.
+func (s *BoltStore) Batch(fn func(*Txn) error) error {
+	return s.raw.Batch(func(tx *bolt.Tx) error {
+		return fn(&Txn{tx: tx, gcm: s.DB.gcm})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.raw.Close()
+}
@@ -0,0 +1,91 @@
+package blight
+
+import "errors"
+
+// Bucket is a typed view over a single bucket in db, avoiding the
+// interface{} marshaling dance of SetJSON/GetJSON/AppendJSON at the call
+// site.
+type Bucket[T any] struct {
+	db     *DB
+	bucket string
+}
+
+// NewBucket returns a typed view over bucket in db.
+func NewBucket[T any](db *DB, bucket string) *Bucket[T] {
+	return &Bucket[T]{db: db, bucket: bucket}
+}
+
+// Get reads key and unmarshals it into a T. The bool result is false if key
+// does not exist, whether or not the bucket itself has been written to yet.
+func (b *Bucket[T]) Get(key string) (T, bool, error) {
+	var zero T
+	var raw []byte
+	err := b.db.View(func(t *Txn) error {
+		v, err := t.rawGet(b.bucket, key)
+		raw = v
+		return err
+	})
+	if errors.Is(err, ErrBucketNotFound) {
+		return zero, false, nil
+	}
+	if err != nil {
+		return zero, false, err
+	}
+	if raw == nil {
+		return zero, false, nil
+	}
+
+	var v T
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return zero, false, err
+	}
+	return v, true, nil
+}
+
+// Set marshals v and stores it at key.
+func (b *Bucket[T]) Set(key string, v T) error {
+	return b.db.Update(func(t *Txn) error {
+		return t.SetJSON(b.bucket, key, v)
+	})
+}
+
+// Append marshals v and stores it under a sequence-generated key, returning
+// the generated id.
+func (b *Bucket[T]) Append(v T) (uint64, error) {
+	var id uint64
+	err := b.db.Update(func(t *Txn) error {
+		var err error
+		id, err = t.AppendJSON(b.bucket, v)
+		return err
+	})
+	return id, err
+}
+
+// Delete removes key.
+func (b *Bucket[T]) Delete(key string) error {
+	return b.db.Update(func(t *Txn) error {
+		return t.Delete(b.bucket, key)
+	})
+}
+
+// Range iterates over the bucket according to opts, unmarshaling each value
+// into a T before calling fn.
+func (b *Bucket[T]) Range(opts RangeOptions, fn func(key string, v T) error) error {
+	return b.db.Range(b.bucket, opts, func(k, v []byte) error {
+		var item T
+		if err := json.Unmarshal(v, &item); err != nil {
+			return err
+		}
+		return fn(string(k), item)
+	})
+}
+
+// List returns every value in the bucket, unmarshaled into a T.
+func (b *Bucket[T]) List() ([]T, error) {
+	var items []T
+	err := b.Range(RangeOptions{}, func(_ string, v T) error {
+		items = append(items, v)
+		return nil
+	})
+	return items, err
+}
@@ -0,0 +1,176 @@
+package blight
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVPair is a versioned value read from a bucket, in the style of
+// libkv/store.KVPair. LastIndex is the version of the value as stored at
+// read time, and must be passed back in to CompareAndSwap/AtomicDelete to
+// detect concurrent writers.
+type KVPair struct {
+	Key       string
+	Value     []byte
+	LastIndex uint64
+}
+
+// versionSize is the width of the little-endian version prefix stored ahead
+// of every value written through the CAS API.
+const versionSize = 8
+
+// casRegistryBucket records which buckets hold CAS-versioned values (a
+// version prefix ahead of the payload) rather than plain JSON, so
+// MigrateEncryption knows how to re-key each bucket's values correctly.
+const casRegistryBucket = "__blight_cas_buckets__"
+
+// GetVersioned reads key from bucket and returns it along with the version
+// it was written with.
+func (d DB) GetVersioned(bucket, key string) (*KVPair, error) {
+	var pair *KVPair
+	err := d.db.View(func(tx *bolt.Tx) error {
+		p, err := getVersionedTx(tx, []byte(bucket), []byte(key))
+		pair = p
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pair != nil && d.gcm != nil {
+		v, err := decrypt(d.gcm, pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		pair.Value = v
+	}
+	return pair, nil
+}
+
+// CompareAndSwap writes next to bucket/key only if the value currently
+// stored there is still at previous.LastIndex. previous may be nil to mean
+// "key must not already exist". It returns whether the swap took place.
+func (d DB) CompareAndSwap(bucket, key string, previous *KVPair, next []byte) (bool, error) {
+	var swapped bool
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		ok, err := compareAndSwapTx(tx, []byte(bucket), []byte(key), previous, next, d.gcm)
+		swapped = ok
+		return err
+	})
+	return swapped, err
+}
+
+// CompareAndSwapJSON marshals next and performs a CompareAndSwap with it.
+func (d DB) CompareAndSwapJSON(bucket, key string, previous *KVPair, next interface{}) (bool, error) {
+	j, err := json.Marshal(next)
+	if err != nil {
+		return false, err
+	}
+	return d.CompareAndSwap(bucket, key, previous, j)
+}
+
+// AtomicDelete removes bucket/key only if the value currently stored there
+// is still at previous.LastIndex. It returns whether the delete took place.
+func (d DB) AtomicDelete(bucket, key string, previous *KVPair) (bool, error) {
+	var deleted bool
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %q not found", bucket)
+		}
+
+		current, err := decodeVersioned(key, b.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		if current == nil || previous == nil || current.LastIndex != previous.LastIndex {
+			return nil
+		}
+
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+		deleted = true
+		return nil
+	})
+	return deleted, err
+}
+
+func getVersionedTx(tx *bolt.Tx, bucket, key []byte) (*KVPair, error) {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil, fmt.Errorf("bucket %q not found", string(bucket))
+	}
+	return decodeVersioned(string(key), b.Get(key))
+}
+
+func compareAndSwapTx(tx *bolt.Tx, bucket, key []byte, previous *KVPair, next []byte, gcm cipher.AEAD) (bool, error) {
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := decodeVersioned(string(key), b.Get(key))
+	if err != nil {
+		return false, err
+	}
+
+	var currentIndex uint64
+	if current != nil {
+		currentIndex = current.LastIndex
+	}
+	var previousIndex uint64
+	if previous != nil {
+		previousIndex = previous.LastIndex
+	}
+	if currentIndex != previousIndex {
+		return false, nil
+	}
+
+	payload := next
+	if gcm != nil {
+		if payload, err = encrypt(gcm, next); err != nil {
+			return false, err
+		}
+	}
+
+	encoded := make([]byte, versionSize+len(payload))
+	binary.LittleEndian.PutUint64(encoded, currentIndex+1)
+	copy(encoded[versionSize:], payload)
+
+	if err := b.Put(key, encoded); err != nil {
+		return false, err
+	}
+	if err := registerCASBucket(tx, bucket); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// registerCASBucket records bucket as holding CAS-versioned values, so
+// MigrateEncryption knows to preserve its version prefix when re-keying.
+func registerCASBucket(tx *bolt.Tx, bucket []byte) error {
+	reg, err := tx.CreateBucketIfNotExists([]byte(casRegistryBucket))
+	if err != nil {
+		return err
+	}
+	return reg.Put(bucket, []byte{1})
+}
+
+// decodeVersioned splits a stored value into its version and payload. A nil
+// raw value (key absent) returns a nil pair and no error.
+func decodeVersioned(key string, raw []byte) (*KVPair, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if len(raw) < versionSize {
+		return nil, fmt.Errorf("value for key %q is too short to contain a version prefix", key)
+	}
+	return &KVPair{
+		Key:       key,
+		Value:     append([]byte(nil), raw[versionSize:]...),
+		LastIndex: binary.LittleEndian.Uint64(raw[:versionSize]),
+	}, nil
+}
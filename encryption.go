@@ -0,0 +1,185 @@
+package blight
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// metaBucket is a reserved bucket used to record DB-level settings, such as
+// whether encryption is in effect. NewEncrypted refuses a database whose
+// flag records plaintext (as MigrateEncryption writes when newKey is nil).
+// New does not read the flag, and NewEncrypted accepts a database that has
+// no flag yet and records it as encrypted.
+const metaBucket = "__blight_meta__"
+
+const encryptedMetaKey = "encrypted"
+
+// EncryptionOptions holds at-rest encryption settings. NewEncrypted takes
+// its key as a plain []byte rather than an EncryptionOptions; Key is the
+// value to pass to it.
+type EncryptionOptions struct {
+	// Key is the AES-256 key used to encrypt/decrypt values. It must be 32
+	// bytes long.
+	Key []byte
+}
+
+// NewEncrypted wraps db the same way New does, but transparently encrypts
+// every value written through SetJSON/GetJSON/AppendJSON (and the Txn
+// equivalents) with AES-GCM, prefixing each stored value with a random
+// 12-byte nonce.
+func NewEncrypted(db *bolt.DB, key []byte) (*DB, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DB{db: db, gcm: gcm}
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+
+		existing := b.Get([]byte(encryptedMetaKey))
+		if existing == nil {
+			return b.Put([]byte(encryptedMetaKey), []byte{1})
+		}
+		if existing[0] != 1 {
+			return fmt.Errorf("blight: database was opened unencrypted and cannot be reopened with NewEncrypted")
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// IsEncrypted reports whether d was opened with NewEncrypted.
+func (d DB) IsEncrypted() bool {
+	return d.gcm != nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("blight: encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt prepends a random nonce to the AES-GCM sealed plaintext.
+func encrypt(gcm cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt strips the nonce prefix written by encrypt and opens the sealed box.
+func decrypt(gcm cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	n := gcm.NonceSize()
+	if len(ciphertext) < n {
+		return nil, fmt.Errorf("blight: ciphertext too short to contain a nonce")
+	}
+	return gcm.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
+
+// MigrateEncryption re-encrypts every value in db from oldKey to newKey. Pass
+// a nil oldKey to migrate from a plaintext database, or a nil newKey to
+// remove encryption entirely.
+func MigrateEncryption(db *bolt.DB, oldKey, newKey []byte) error {
+	var oldGCM, newAEAD cipher.AEAD
+	var err error
+	if oldKey != nil {
+		if oldGCM, err = newGCM(oldKey); err != nil {
+			return err
+		}
+	}
+	if newKey != nil {
+		if newAEAD, err = newGCM(newKey); err != nil {
+			return err
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		casBuckets := map[string]bool{}
+		if reg := tx.Bucket([]byte(casRegistryBucket)); reg != nil {
+			c := reg.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				casBuckets[string(k)] = true
+			}
+		}
+
+		if err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == metaBucket || string(name) == casRegistryBucket {
+				return nil
+			}
+			isCAS := casBuckets[string(name)]
+
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				// CAS-versioned buckets carry a version prefix ahead of the
+				// payload, which must survive re-keying untouched.
+				var version []byte
+				payload := v
+				if isCAS {
+					if len(v) < versionSize {
+						return fmt.Errorf("cas value for key %q in bucket %q is too short to contain a version prefix", string(k), string(name))
+					}
+					version = append([]byte(nil), v[:versionSize]...)
+					payload = v[versionSize:]
+				}
+
+				plain := payload
+				if oldGCM != nil {
+					p, err := decrypt(oldGCM, payload)
+					if err != nil {
+						return err
+					}
+					plain = p
+				}
+
+				out := plain
+				if newAEAD != nil {
+					o, err := encrypt(newAEAD, plain)
+					if err != nil {
+						return err
+					}
+					out = o
+				}
+				if isCAS {
+					out = append(version, out...)
+				}
+				if err := b.Put(append([]byte(nil), k...), out); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// Record the mode we migrated to, so a later NewEncrypted call can
+		// tell whether it matches what's actually on disk. New does not
+		// read this flag.
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		var flag byte
+		if newKey != nil {
+			flag = 1
+		}
+		return meta.Put([]byte(encryptedMetaKey), []byte{flag})
+	})
+}
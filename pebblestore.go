@@ -0,0 +1,211 @@
+package blight
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// bucketSep separates a bucket name from its keys when both are packed into
+// a single Pebble key, so buckets behave like the cheap namespaces bbolt
+// gives for free.
+const bucketSep = 0x00
+
+// pebbleSeqBucket is a reserved namespace holding one persistent sequence
+// counter per bucket, so Append keeps handing out ids that were never used
+// even after the highest id so far is deleted (bbolt's NextSequence never
+// reuses an id either).
+const pebbleSeqBucket = "__blight_seq__"
+
+// PebbleStore is a Store backed by a Pebble LSM. Buckets are modelled as key
+// prefixes ("bucket\x00key") rather than bbolt's native nested buckets,
+// since Pebble has no such concept.
+type PebbleStore struct {
+	db *pebble.DB
+
+	// seqMu serializes sequence allocation so two concurrent Appends to the
+	// same bucket never hand out the same id.
+	seqMu sync.Mutex
+}
+
+// NewPebbleStore opens (creating if necessary) a Pebble database at path.
+func NewPebbleStore(path string) (*PebbleStore, error) {
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &PebbleStore{db: db}, nil
+}
+
+func pebbleKey(bucket, key []byte) []byte {
+	k := make([]byte, 0, len(bucket)+1+len(key))
+	k = append(k, bucket...)
+	k = append(k, bucketSep)
+	k = append(k, key...)
+	return k
+}
+
+// Get returns nil, nil if key isn't present, matching getTx's behaviour for
+// a bucket that exists but doesn't contain key. Pebble has no notion of a
+// bucket existing independently of its keys, so there is no equivalent of
+// bbolt's "bucket not found" error here.
+func (s *PebbleStore) Get(bucket, key []byte) ([]byte, error) {
+	v, closer, err := s.db.Get(pebbleKey(bucket, key))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return append([]byte(nil), v...), nil
+}
+
+func (s *PebbleStore) Set(bucket, key, value []byte) error {
+	return s.db.Set(pebbleKey(bucket, key), value, pebble.Sync)
+}
+
+func (s *PebbleStore) Delete(bucket, key []byte) error {
+	return s.db.Delete(pebbleKey(bucket, key), pebble.Sync)
+}
+
+func (s *PebbleStore) Append(bucket, value []byte) error {
+	_, err := s.appendTx(bucket, value)
+	return err
+}
+
+// appendTx is Append plus the id it generated, for Txn.AppendJSON.
+func (s *PebbleStore) appendTx(bucket, value []byte) (uint64, error) {
+	id, err := s.nextSequence(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return id, s.Set(bucket, itob(id), value)
+}
+
+// nextSequence bumps and returns the persistent sequence counter for
+// bucket, stored under the reserved pebbleSeqBucket namespace so it's never
+// confused with the bucket's own keys and never goes backwards, even after
+// the id it last handed out is deleted.
+func (s *PebbleStore) nextSequence(bucket []byte) (uint64, error) {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+
+	key := pebbleKey([]byte(pebbleSeqBucket), bucket)
+	v, closer, err := s.db.Get(key)
+	var id uint64
+	switch err {
+	case nil:
+		id = binaryBigEndianUint64(v)
+		closer.Close()
+	case pebble.ErrNotFound:
+	default:
+		return 0, err
+	}
+
+	id++
+	if err := s.db.Set(key, itob(id), pebble.Sync); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *PebbleStore) Range(bucket string, opts RangeOptions, fn func(k, v []byte) error) error {
+	prefix := append([]byte(bucket), bucketSep)
+
+	lower := append(append([]byte(nil), prefix...), opts.Prefix...)
+	if opts.StartKey != nil {
+		lower = append(append([]byte(nil), prefix...), opts.StartKey...)
+	}
+	upper := keyUpperBound(append(append([]byte(nil), prefix...), opts.Prefix...))
+	if opts.EndKey != nil {
+		upper = append(append([]byte(nil), prefix...), opts.EndKey...)
+	}
+
+	iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	valid := iter.First
+	advance := iter.Next
+	if opts.Reverse {
+		valid = iter.Last
+		advance = iter.Prev
+	}
+
+	count := 0
+	for ok := valid(); ok; ok = advance() {
+		if opts.Limit > 0 && count >= opts.Limit {
+			break
+		}
+		k := bytes.TrimPrefix(iter.Key(), prefix)
+		if opts.Prefix != nil && !bytes.HasPrefix(k, opts.Prefix) {
+			continue
+		}
+		count++
+		if err := fn(append([]byte(nil), k...), append([]byte(nil), iter.Value()...)); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// keyUpperBound returns the smallest key that sorts after every key with
+// prefix, for use as a Pebble IterOptions.UpperBound.
+func keyUpperBound(prefix []byte) []byte {
+	upper := append([]byte(nil), prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] == 0xff {
+			continue
+		}
+		upper[i]++
+		return upper[:i+1]
+	}
+	return nil
+}
+
+func binaryBigEndianUint64(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// Batch runs fn exactly as Update does: each operation fn performs is written
+// to Pebble directly with its own sync write, not collected into a Pebble
+// batch, so the operations are not applied atomically. Pebble has no
+// background batch coalescing like bbolt's Batch, so this simply gives
+// callers the same Txn-shaped API.
+func (s *PebbleStore) Batch(fn func(*Txn) error) error {
+	return s.Update(fn)
+}
+
+func (s *PebbleStore) View(fn func(*Txn) error) error {
+	return fn(&Txn{pebbleStore: s})
+}
+
+func (s *PebbleStore) Update(fn func(*Txn) error) error {
+	return fn(&Txn{pebbleStore: s})
+}
+
+func (s *PebbleStore) CreateBucket(bucket string) error {
+	// Buckets are just key prefixes in Pebble; there is nothing to create
+	// up front.
+	return nil
+}
+
+func (s *PebbleStore) DeleteBucket(bucket string) error {
+	prefix := append([]byte(bucket), bucketSep)
+	return s.db.DeleteRange(prefix, keyUpperBound(prefix), pebble.Sync)
+}
+
+func (s *PebbleStore) Close() error {
+	return s.db.Close()
+}
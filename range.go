@@ -0,0 +1,270 @@
+package blight
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrStopIteration can be returned by a Range callback to stop iteration
+// early without it being treated as a failure.
+var ErrStopIteration = errors.New("blight: stop iteration")
+
+// KV is a single key/value pair copied out of a bucket.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// RangeOptions controls which part of a bucket DB.Range visits, and how.
+type RangeOptions struct {
+	// Prefix, if set, restricts iteration to keys with this prefix.
+	Prefix []byte
+	// StartKey, if set, is the first key visited (inclusive).
+	StartKey []byte
+	// EndKey, if set, is the last key visited (exclusive).
+	EndKey []byte
+	// Reverse iterates from the end of the range towards the start.
+	Reverse bool
+	// Limit caps the number of keys visited. Zero means no limit.
+	Limit int
+	// Parallel, if greater than 1, dispatches fn calls to a bounded worker
+	// pool instead of calling fn inline. Keys and values are always copied
+	// before being handed to fn, so they remain valid after the worker pool
+	// has moved on.
+	Parallel int
+}
+
+// Range iterates over bucket according to opts, calling fn with a copy of
+// each key/value. fn may run on a worker pool when opts.Parallel > 1, so it
+// must not assume calls happen in order or on the calling goroutine. Returning
+// ErrStopIteration from fn stops iteration early without it being reported as
+// an error; any other error aborts iteration and is returned from Range.
+func (d DB) Range(bucket string, opts RangeOptions, fn func(k, v []byte) error) error {
+	if opts.Parallel > 1 {
+		return d.rangeParallel(bucket, opts, fn)
+	}
+
+	return d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %q not found", bucket)
+		}
+
+		count := 0
+		return walk(b, opts, func(k, v []byte) error {
+			if opts.Limit > 0 && count >= opts.Limit {
+				return ErrStopIteration
+			}
+			count++
+
+			val, err := d.decryptCopy(v)
+			if err != nil {
+				return err
+			}
+			return fn(append([]byte(nil), k...), val)
+		})
+	})
+}
+
+// decryptCopy returns a copy of v or, if d was opened with NewEncrypted, the
+// decryption of v into a newly allocated slice.
+func (d DB) decryptCopy(v []byte) ([]byte, error) {
+	val := append([]byte(nil), v...)
+	if d.gcm == nil {
+		return val, nil
+	}
+	return decrypt(d.gcm, val)
+}
+
+func (d DB) rangeParallel(bucket string, opts RangeOptions, fn func(k, v []byte) error) error {
+	wg := sync.WaitGroup{}
+	tokens := make(chan struct{}, opts.Parallel)
+	for i := 0; i < opts.Parallel; i++ {
+		tokens <- struct{}{}
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	var stopped bool
+	// reportErr records a worker's result. ErrStopIteration just raises the
+	// stop flag; any other error is also remembered as firstErr, to be
+	// returned from Range once every dispatched worker has finished.
+	reportErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		if err != ErrStopIteration && firstErr == nil {
+			firstErr = err
+		}
+	}
+	isStopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return stopped
+	}
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %q not found", bucket)
+		}
+
+		count := 0
+		return walk(b, opts, func(k, v []byte) error {
+			// Stop handing out new work as soon as any worker has
+			// signalled ErrStopIteration or a real error, rather than
+			// dispatching the rest of the range to the pool.
+			if isStopped() {
+				return ErrStopIteration
+			}
+			if opts.Limit > 0 && count >= opts.Limit {
+				return ErrStopIteration
+			}
+			count++
+
+			kc := append([]byte(nil), k...)
+			vc, err := d.decryptCopy(v)
+			if err != nil {
+				return err
+			}
+			<-tokens
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { tokens <- struct{}{} }()
+				if err := fn(kc, vc); err != nil {
+					reportErr(err)
+				}
+			}()
+			return nil
+		})
+	})
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// Scan returns up to limit items from bucket starting after cursor, along
+// with the cursor to pass in to continue from where it left off. An empty
+// nextCursor means there are no more items. cursor is always the key of the
+// last item returned by the previous call, and is treated as exclusive, so
+// no key is ever skipped or returned twice across pages.
+func (d DB) Scan(bucket, cursor string, limit int) (items []KV, nextCursor string, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %q not found", bucket)
+		}
+
+		c := b.Cursor()
+		var k, v []byte
+		if cursor == "" {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek([]byte(cursor))
+			if k != nil && bytes.Equal(k, []byte(cursor)) {
+				k, v = c.Next()
+			}
+		}
+
+		for len(items) < limit && k != nil {
+			val, err := d.decryptCopy(v)
+			if err != nil {
+				return err
+			}
+			items = append(items, KV{
+				Key:   append([]byte(nil), k...),
+				Value: val,
+			})
+			k, v = c.Next()
+		}
+		if k != nil {
+			nextCursor = string(items[len(items)-1].Key)
+		}
+		return nil
+	})
+	return items, nextCursor, err
+}
+
+// walk drives a bucket's cursor according to opts, calling fn for each
+// key/value in range. The slices passed to fn are only valid for the
+// lifetime of the enclosing transaction.
+func walk(b *bolt.Bucket, opts RangeOptions, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+
+	// start/end fold Prefix into the effective [start, end) bound, so a
+	// single inRange check covers Prefix, StartKey and EndKey together.
+	start, end := opts.StartKey, opts.EndKey
+	if opts.Prefix != nil {
+		if start == nil || bytes.Compare(opts.Prefix, start) > 0 {
+			start = opts.Prefix
+		}
+		if prefixEnd := keyUpperBound(opts.Prefix); prefixEnd != nil {
+			if end == nil || bytes.Compare(prefixEnd, end) < 0 {
+				end = prefixEnd
+			}
+		}
+	}
+
+	inRange := func(k []byte) bool {
+		if k == nil {
+			return false
+		}
+		if opts.Prefix != nil && !bytes.HasPrefix(k, opts.Prefix) {
+			return false
+		}
+		if end != nil && bytes.Compare(k, end) >= 0 {
+			return false
+		}
+		if start != nil && bytes.Compare(k, start) < 0 {
+			return false
+		}
+		return true
+	}
+
+	var k, v []byte
+	if opts.Reverse {
+		if end != nil {
+			k, v = c.Seek(end)
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+	} else if start != nil {
+		k, v = c.Seek(start)
+	} else {
+		k, v = c.First()
+	}
+
+	next := c.Next
+	if opts.Reverse {
+		next = c.Prev
+	}
+
+	for ; k != nil; k, v = next() {
+		// Once the cursor leaves the bound it never re-enters it, in
+		// either direction, so stop instead of scanning the rest of
+		// the bucket.
+		if !inRange(k) {
+			break
+		}
+
+		if err := fn(k, v); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package blight
+
+import bolt "go.etcd.io/bbolt"
+
+// Store is the set of operations any blight backend must support. bbolt's
+// single-writer model limits write throughput for some workloads; Store lets
+// callers swap in a different engine (see PebbleStore) while keeping the
+// same SetJSON/GetJSON/AppendJSON ergonomics on top.
+type Store interface {
+	Get(bucket, key []byte) ([]byte, error)
+	Set(bucket, key, value []byte) error
+	Delete(bucket, key []byte) error
+	Append(bucket, value []byte) error
+	Range(bucket string, opts RangeOptions, fn func(k, v []byte) error) error
+	Batch(fn func(*Txn) error) error
+	View(fn func(*Txn) error) error
+	Update(fn func(*Txn) error) error
+	CreateBucket(bucket string) error
+	DeleteBucket(bucket string) error
+	Close() error
+}
+
+// Engine selects which backend Open uses.
+type Engine string
+
+const (
+	// EngineBolt stores data in a bbolt file, the default blight backend.
+	EngineBolt Engine = "bbolt"
+	// EnginePebble stores data in a Pebble LSM, trading bbolt's single
+	// writer for higher write throughput.
+	EnginePebble Engine = "pebble"
+)
+
+// Options configures Open.
+type Options struct {
+	// Engine selects the storage backend. Defaults to EngineBolt.
+	Engine Engine
+}
+
+// Open opens (creating if necessary) the database at path using the engine
+// named in opts.Engine, and returns it behind the Store interface.
+func Open(path string, opts Options) (Store, error) {
+	switch opts.Engine {
+	case "", EngineBolt:
+		db, err := bolt.Open(path, 0600, nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewBoltStore(db), nil
+	case EnginePebble:
+		return NewPebbleStore(path)
+	default:
+		return nil, &unsupportedEngineError{opts.Engine}
+	}
+}
+
+type unsupportedEngineError struct {
+	engine Engine
+}
+
+func (e *unsupportedEngineError) Error() string {
+	return "blight: unsupported engine " + string(e.engine)
+}
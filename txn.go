@@ -0,0 +1,179 @@
+package blight
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrBucketNotFound is wrapped into the error returned when a bbolt-backed
+// Get, GetJSON or Txn read targets a bucket that doesn't exist yet. Other
+// functions that report a missing bucket (Delete, Range, Scan, GetVersioned,
+// AtomicDelete) return an error that does not wrap it.
+var ErrBucketNotFound = errors.New("blight: bucket not found")
+
+// Txn wraps a *bolt.Tx, giving callers of DB.View/DB.Update a way to compose
+// several reads and writes into a single atomic transaction.
+//
+// Txn also backs PebbleStore.View/Update: Pebble has no transaction type of
+// its own, so a Txn over a PebbleStore just applies each operation directly
+// and isn't atomic across multiple calls the way the bbolt-backed Txn is.
+type Txn struct {
+	tx  *bolt.Tx
+	gcm cipher.AEAD
+
+	pebbleStore *PebbleStore
+}
+
+// View runs fn in a read-only transaction.
+func (d DB) View(fn func(*Txn) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return fn(&Txn{tx: tx, gcm: d.gcm})
+	})
+}
+
+// Update runs fn in a read-write transaction.
+func (d DB) Update(fn func(*Txn) error) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return fn(&Txn{tx: tx, gcm: d.gcm})
+	})
+}
+
+// rawGet reads the raw (decrypted) bytes stored at bucket/key. It returns a
+// nil slice and no error if the key is absent; for the bbolt backend, an
+// error wrapping ErrBucketNotFound is returned instead if bucket itself
+// doesn't exist.
+func (t *Txn) rawGet(bucket, key string) ([]byte, error) {
+	var v []byte
+	var err error
+	if t.pebbleStore != nil {
+		v, err = t.pebbleStore.Get([]byte(bucket), []byte(key))
+	} else {
+		v, err = getTx(t.tx, []byte(bucket), []byte(key))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.gcm != nil && v != nil {
+		return decrypt(t.gcm, v)
+	}
+	return v, nil
+}
+
+// GetJSON unmarshals the value stored at bucket/key into value.
+func (t *Txn) GetJSON(bucket, key string, value interface{}) error {
+	v, err := t.rawGet(bucket, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(v, &value)
+}
+
+// SetJSON marshals value and stores it at bucket/key.
+func (t *Txn) SetJSON(bucket, key string, value interface{}) error {
+	j, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if t.gcm != nil {
+		if j, err = encrypt(t.gcm, j); err != nil {
+			return err
+		}
+	}
+	if t.pebbleStore != nil {
+		return t.pebbleStore.Set([]byte(bucket), []byte(key), j)
+	}
+	return setTx(t.tx, []byte(bucket), []byte(key), j)
+}
+
+// AppendJSON marshals value and stores it under a sequence-generated key in
+// bucket, returning the generated id.
+func (t *Txn) AppendJSON(bucket string, value interface{}) (uint64, error) {
+	j, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	if t.gcm != nil {
+		if j, err = encrypt(t.gcm, j); err != nil {
+			return 0, err
+		}
+	}
+	if t.pebbleStore != nil {
+		return t.pebbleStore.appendTx([]byte(bucket), j)
+	}
+	return appendTx(t.tx, []byte(bucket), j)
+}
+
+// Delete removes key from bucket.
+func (t *Txn) Delete(bucket, key string) error {
+	if t.pebbleStore != nil {
+		return t.pebbleStore.Delete([]byte(bucket), []byte(key))
+	}
+	return deleteTx(t.tx, []byte(bucket), []byte(key))
+}
+
+// ResetBucket deletes bucket and recreates it empty. On the bbolt backend it
+// returns an error if bucket does not exist.
+func (t *Txn) ResetBucket(bucket string) error {
+	if t.pebbleStore != nil {
+		return t.pebbleStore.DeleteBucket(bucket)
+	}
+	return resetBucketTx(t.tx, []byte(bucket))
+}
+
+// setTx writes key/value to bucket within an existing transaction.
+func setTx(tx *bolt.Tx, bucket, key, value []byte) error {
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// getTx reads key from bucket within an existing transaction.
+func getTx(tx *bolt.Tx, bucket, key []byte) ([]byte, error) {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil, fmt.Errorf("bucket %q not found: %w", string(bucket), ErrBucketNotFound)
+	}
+	return b.Get(key), nil
+}
+
+// appendTx writes value to bucket under a sequence-generated key within an
+// existing transaction, returning the generated id.
+func appendTx(tx *bolt.Tx, bucket, value []byte) (uint64, error) {
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return 0, err
+	}
+
+	// Generate ID.
+	// This returns an error only if the Tx is closed or not writeable.
+	// That can't happen inside Update()/Batch() so I ignore the error check.
+	id, _ := b.NextSequence()
+
+	if err := b.Put(itob(id), value); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// deleteTx removes key from bucket within an existing transaction.
+func deleteTx(tx *bolt.Tx, bucket, key []byte) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("bucket %q not found", string(bucket))
+	}
+	return b.Delete(key)
+}
+
+// resetBucketTx empties bucket within an existing transaction.
+func resetBucketTx(tx *bolt.Tx, bucket []byte) error {
+	if err := tx.DeleteBucket(bucket); err != nil {
+		return err
+	}
+	_, err := tx.CreateBucketIfNotExists(bucket)
+	return err
+}
@@ -0,0 +1,85 @@
+package blight
+
+import (
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// WriterOptions tunes how a Writer coalesces writes before flushing them to
+// bbolt, mirroring Portainer's MaxBatchSize/MaxBatchDelay tunables.
+type WriterOptions struct {
+	// MaxBatchSize is the number of pending writes that triggers an
+	// immediate flush. Zero leaves the underlying bolt.DB's current
+	// MaxBatchSize unchanged.
+	MaxBatchSize int
+	// MaxBatchDelay is how long a write waits for others to join its batch
+	// before being flushed on its own. Zero leaves the underlying bolt.DB's
+	// current MaxBatchDelay unchanged.
+	MaxBatchDelay time.Duration
+}
+
+// Writer batches SetJSON calls using bbolt's own DB.Batch, so concurrent
+// callers share fewer, larger transactions while each still gets back the
+// error for its own write, not one shared error for the whole batch.
+type Writer struct {
+	d *DB
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewWriter creates a Writer that batches writes to d according to opts.
+// opts.MaxBatchSize and opts.MaxBatchDelay are applied directly to the
+// underlying *bolt.DB, which is what actually drives the batching.
+func (d DB) NewWriter(opts WriterOptions) *Writer {
+	if opts.MaxBatchSize > 0 {
+		d.db.MaxBatchSize = opts.MaxBatchSize
+	}
+	if opts.MaxBatchDelay > 0 {
+		d.db.MaxBatchDelay = opts.MaxBatchDelay
+	}
+	return &Writer{d: &d}
+}
+
+// SetJSON marshals value and writes it through DB.Batch, blocking until it
+// has been durably written (or failed) and returning that error, if any.
+func (w *Writer) SetJSON(bucket, key string, value interface{}) error {
+	j, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if w.d.gcm != nil {
+		if j, err = encrypt(w.d.gcm, j); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	closed := w.closed
+	w.mu.Unlock()
+	if closed {
+		return errWriterClosed
+	}
+
+	b, k := []byte(bucket), []byte(key)
+	return w.d.db.Batch(func(tx *bolt.Tx) error {
+		return setTx(tx, b, k, j)
+	})
+}
+
+// Close stops the Writer from accepting new writes. Any write already
+// admitted to a batch runs to completion independently of Close.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	return nil
+}
+
+var errWriterClosed = &writerClosedError{}
+
+type writerClosedError struct{}
+
+func (*writerClosedError) Error() string { return "blight: writer is closed" }